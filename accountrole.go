@@ -6,20 +6,44 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+
+	"github.com/alvin-rw/aws-access-keys-id-lister/internal/auth"
+)
+
+// Column layout of the account list CSV. Each row declares one account and
+// the auth method used to reach it; only the columns relevant to that
+// method need to be populated, the rest are left empty.
+const (
+	csvColAccountID = iota
+	csvColAuthMethod
+	csvColRoleARN
+	csvColExternalID
+	csvColMFASerial
+	csvColSSOAccountID
+	csvColSSORoleName
+	csvColProfileName
+	csvColumnCount
 )
 
-// getAccountRoleListFromCSV reads the account list CSV file line by line
-// and validates each line using the validateCSVAccountRoleData function
-func getAccountRoleListFromCSV(filename string) ([][]string, error) {
+// legacyCSVColumnCount is the column count of account lists that predate
+// the auth-method column: just AccountID and RoleARN, implying assume_role.
+const legacyCSVColumnCount = 2
+
+// getAccountRoleListFromCSV reads the account list CSV file line by line,
+// validates each line using validateCSVAccountRoleData, and parses it into
+// an auth.AccountConfig.
+func getAccountRoleListFromCSV(filename string) ([]auth.AccountConfig, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	var accountRoleList [][]string
+	var accountList []auth.AccountConfig
 
 	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
 
 	for {
 		record, err := r.Read()
@@ -33,15 +57,33 @@ func getAccountRoleListFromCSV(filename string) ([][]string, error) {
 			}
 		}
 
+		record = normalizeLegacyRecord(record)
+
 		err = validateCSVAccountRoleData(record)
 		if err != nil {
 			return nil, err
 		}
 
-		accountRoleList = append(accountRoleList, record)
+		accountList = append(accountList, parseAccountConfig(record))
+	}
+
+	return accountList, err
+}
+
+// normalizeLegacyRecord pads a legacyCSVColumnCount row (AccountID, RoleARN)
+// out to the full column layout so it passes validateCSVAccountRoleData and
+// parses as an assume_role account, keeping account lists written before the
+// auth-method column readable.
+func normalizeLegacyRecord(record []string) []string {
+	if len(record) != legacyCSVColumnCount {
+		return record
 	}
 
-	return accountRoleList, err
+	normalized := make([]string, csvColumnCount)
+	normalized[csvColAccountID] = record[0]
+	normalized[csvColAuthMethod] = string(auth.MethodAssumeRole)
+	normalized[csvColRoleARN] = record[1]
+	return normalized
 }
 
 func validateCSVAccountRoleData(record []string) error {
@@ -51,11 +93,11 @@ func validateCSVAccountRoleData(record []string) error {
 		return fmt.Errorf("account role must contain some data")
 	}
 
-	accountId := record[0]
+	accountId := record[csvColAccountID]
 
 	switch {
-	case len(record) != 2:
-		return fmt.Errorf("validation failed for account %s, the number of data for this account is not 2 columns", accountId)
+	case len(record) != csvColumnCount:
+		return fmt.Errorf("validation failed for account %s, the number of data for this account is not %d columns", accountId, csvColumnCount)
 	case len(accountId) != 12:
 		return fmt.Errorf("validation failed for account %s, the account id must be 12 characters", accountId)
 	default:
@@ -63,22 +105,50 @@ func validateCSVAccountRoleData(record []string) error {
 	}
 }
 
-// getRoleARN formats accountRoleData into AWS IAM Role ARN format
-func getRoleARN(accountRoleData []string) string {
-	accountId := accountRoleData[0]
-	roleName := accountRoleData[1]
-
-	roleARN := fmt.Sprintf("arn:aws:iam::%s:role/%s", accountId, roleName)
+// parseAccountConfig maps a validated CSV row into an auth.AccountConfig.
+// An empty auth_method column defaults to assume_role; legacy 2-column rows
+// are padded to this shape by normalizeLegacyRecord before they reach here.
+func parseAccountConfig(record []string) auth.AccountConfig {
+	method := auth.Method(record[csvColAuthMethod])
+	if method == "" {
+		method = auth.MethodAssumeRole
+	}
 
-	return roleARN
+	return auth.AccountConfig{
+		AccountID:       record[csvColAccountID],
+		Method:          method,
+		RoleARN:         record[csvColRoleARN],
+		ExternalID:      record[csvColExternalID],
+		MFASerialNumber: record[csvColMFASerial],
+		SSOAccountID:    record[csvColSSOAccountID],
+		SSORoleName:     record[csvColSSORoleName],
+		ProfileName:     record[csvColProfileName],
+	}
 }
 
-// getRoleARN gets the AWS Account ID from the accountRoleData
-func getAccountId(accountRoleData []string) string {
-	return accountRoleData[0]
+// classifyKeySeverity buckets an access key into a rotation-policy severity
+// based on its age in days and, for the "unused" bucket, how recently it was
+// last used. daysSinceLastUsed is -1 when the key has never been used or
+// usage data wasn't fetched for it (e.g. an inactive key), in which case age
+// alone decides "unused".
+func classifyKeySeverity(ageDays, daysSinceLastUsed, warnDays, staleDays, unusedDays int) string {
+	switch {
+	case ageDays >= unusedDays && (daysSinceLastUsed < 0 || daysSinceLastUsed >= unusedDays):
+		return "unused"
+	case ageDays >= staleDays:
+		return "stale"
+	case ageDays >= warnDays:
+		return "warn"
+	default:
+		return "ok"
+	}
 }
 
-func writeRecordsToCSV(filename string, userList []outputUser) error {
+// writeRecordsToCSV writes one row per discovered access key, including its
+// age and rotation-policy severity. When onlyViolations is true, keys
+// classified as "ok" are omitted so the report only surfaces keys that
+// breach the rotation policy.
+func writeRecordsToCSV(filename string, userList []outputUser, onlyViolations bool) error {
 	f, err := os.Create(filename)
 	if err != nil {
 		return err
@@ -87,18 +157,124 @@ func writeRecordsToCSV(filename string, userList []outputUser) error {
 
 	w := csv.NewWriter(f)
 
+	header := []string{
+		"AccountID",
+		"UserName",
+		"AccessKeyID",
+		"CreatedDate",
+		"Status",
+		"AgeDays",
+		"Severity",
+		"LastUsedDate",
+		"LastUsedService",
+		"LastUsedRegion",
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+
 	for _, user := range userList {
+		for _, key := range user.accessKeys {
+			if onlyViolations && key.severity == "ok" {
+				continue
+			}
+
+			record := []string{
+				user.accountId,
+				user.name,
+				key.keyId,
+				key.createdDate,
+				key.status,
+				strconv.Itoa(key.ageDays),
+				key.severity,
+				key.lastUsedDate,
+				key.lastUsedService,
+				key.lastUsedRegion,
+			}
+
+			if err := w.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeAuditCSV writes one row per actionAuditEntry, recording every
+// --action mutation attempt (or dry-run candidate) with a timestamp and
+// the key's prior status.
+func writeAuditCSV(filename string, entries []actionAuditEntry) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+
+	header := []string{"Timestamp", "AccountID", "UserName", "AccessKeyID", "Action", "PriorStatus", "DryRun", "Error"}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		errMsg := ""
+		if entry.err != nil {
+			errMsg = entry.err.Error()
+		}
+
 		record := []string{
-			user.accountId,
-			user.name,
+			entry.timestamp,
+			entry.accountId,
+			entry.userName,
+			entry.keyId,
+			entry.action,
+			entry.priorStatus,
+			strconv.FormatBool(entry.dryRun),
+			errMsg,
 		}
-		for _, key := range user.accessKeys {
-			record = append(record, key.keyId)
-			record = append(record, key.createdDate)
+
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// writeErrorsToCSV writes one row per accountError, summarizing the
+// failures encountered during a run alongside the successful output.csv.
+func writeErrorsToCSV(filename string, errs []accountError) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+
+	header := []string{"AccountID", "Stage", "AWSErrorCode", "Error"}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, accErr := range errs {
+		record := []string{
+			accErr.accountId,
+			accErr.stage,
+			accErr.awsErrorCode,
+			accErr.err.Error(),
 		}
 
-		err := w.Write(record)
-		if err != nil {
+		if err := w.Write(record); err != nil {
 			return err
 		}
 	}
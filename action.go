@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// Supported values for options.action. actionReport is the default,
+// read-only behavior; the other two mutate IAM.
+const (
+	actionReport     = "report"
+	actionDeactivate = "deactivate"
+	actionDelete     = "delete"
+)
+
+// assumeRoleSessionName returns the RoleSessionName used when assuming into
+// an account, folding the action into it (e.g.
+// "aws-access-key-lister-deactivate") so CloudTrail shows intent.
+func assumeRoleSessionName(action string) string {
+	if action == actionReport {
+		return "aws-access-key-lister"
+	}
+
+	return fmt.Sprintf("aws-access-key-lister-%s", action)
+}
+
+// actionAuditEntry records a single mutation attempt against an access
+// key, whether it actually ran or was skipped because of --dry-run.
+type actionAuditEntry struct {
+	timestamp   string
+	accountId   string
+	userName    string
+	keyId       string
+	action      string
+	priorStatus string
+	dryRun      bool
+	err         error
+}
+
+// applyAction runs app.opts.action against ak if it is older than
+// app.opts.actionOlderThanDays, and returns the audit entry recording the
+// attempt. It returns nil when app.opts.action is actionReport or ak isn't
+// old enough to be a candidate.
+func (app *application) applyAction(ctx context.Context, iamClient *iam.Client, accountId, userName string, ak types.AccessKeyMetadata, ageDays int) *actionAuditEntry {
+	if app.opts.action == actionReport || ageDays < app.opts.actionOlderThanDays {
+		return nil
+	}
+
+	entry := &actionAuditEntry{
+		timestamp:   time.Now().UTC().Format(time.RFC3339),
+		accountId:   accountId,
+		userName:    userName,
+		keyId:       *ak.AccessKeyId,
+		action:      app.opts.action,
+		priorStatus: string(ak.Status),
+		dryRun:      app.opts.dryRun,
+	}
+
+	if app.opts.dryRun {
+		return entry
+	}
+
+	switch app.opts.action {
+	case actionDeactivate:
+		_, entry.err = iamClient.UpdateAccessKey(ctx, &iam.UpdateAccessKeyInput{
+			AccessKeyId: ak.AccessKeyId,
+			UserName:    &userName,
+			Status:      types.StatusTypeInactive,
+		})
+	case actionDelete:
+		_, entry.err = iamClient.DeleteAccessKey(ctx, &iam.DeleteAccessKeyInput{
+			AccessKeyId: ak.AccessKeyId,
+			UserName:    &userName,
+		})
+	}
+
+	return entry
+}
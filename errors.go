@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/smithy-go"
+)
+
+// accountError records a single failure encountered while processing an
+// account or a user within it. Collecting these instead of calling
+// log.Fatal lets one missing role or one throttled call fail that
+// account/user without aborting the rest of a multi-account run.
+type accountError struct {
+	accountId    string
+	stage        string
+	err          error
+	awsErrorCode string
+}
+
+// newAccountError builds an accountError, pulling the AWS error code out of
+// err when it is a smithy API error.
+func newAccountError(accountId, stage string, err error) accountError {
+	var apiErr smithy.APIError
+
+	code := ""
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	}
+
+	return accountError{
+		accountId:    accountId,
+		stage:        stage,
+		err:          err,
+		awsErrorCode: code,
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Exporter writes the discovered users and access keys to an output sink.
+// The CSV report and the graph export are both Exporters, so main runs the
+// CSV report and, with --graph-export, the graph export over the same
+// userList.
+type Exporter interface {
+	Export(userList []outputUser) error
+}
+
+// csvExporter writes the flat per-access-key CSV report.
+type csvExporter struct {
+	filename       string
+	onlyViolations bool
+}
+
+func (e *csvExporter) Export(userList []outputUser) error {
+	return writeRecordsToCSV(e.filename, userList, e.onlyViolations)
+}
+
+// graphFormat selects how graphExporter serializes nodes and relationships.
+type graphFormat string
+
+const (
+	graphFormatCSV    graphFormat = "csv"
+	graphFormatCypher graphFormat = "cypher"
+)
+
+// graphExporter emits (:Account)-[:CONTAINS]->(:User)-[:OWNS]->(:AccessKey)
+// nodes and relationships, suitable for bulk loading into Neo4j.
+type graphExporter struct {
+	format graphFormat
+
+	// outputDir is used by graphFormatCSV: nodes.csv and rels.csv are
+	// written there in neo4j-admin import header format.
+	outputDir string
+
+	// cypherFile is used by graphFormatCypher: a stream of MERGE statements
+	// is written there.
+	cypherFile string
+}
+
+func (e *graphExporter) Export(userList []outputUser) error {
+	switch e.format {
+	case graphFormatCypher:
+		return e.exportCypher(userList)
+	case graphFormatCSV, "":
+		return e.exportCSV(userList)
+	default:
+		return fmt.Errorf("unsupported graph format %q", e.format)
+	}
+}
+
+// userNodeID uses an ARN built from the user's account id and name as its
+// graph node id, matching how IAM principals are normally referenced across
+// accounts. It assumes the "aws" partition and the default "/" path, so for
+// a user with a custom path it differs from the user's real ARN.
+func userNodeID(u outputUser) string {
+	return fmt.Sprintf("arn:aws:iam::%s:user/%s", u.accountId, u.name)
+}
+
+func (e *graphExporter) exportCSV(userList []outputUser) error {
+	if err := os.MkdirAll(e.outputDir, 0o755); err != nil {
+		return err
+	}
+
+	nodesFile, err := os.Create(filepath.Join(e.outputDir, "nodes.csv"))
+	if err != nil {
+		return err
+	}
+	defer nodesFile.Close()
+
+	relsFile, err := os.Create(filepath.Join(e.outputDir, "rels.csv"))
+	if err != nil {
+		return err
+	}
+	defer relsFile.Close()
+
+	nodesWriter := csv.NewWriter(nodesFile)
+	relsWriter := csv.NewWriter(relsFile)
+
+	nodesHeader := []string{":ID", ":LABEL", "name", "arn", "createdDate", "lastUsed", "status", "ageDays"}
+	if err := nodesWriter.Write(nodesHeader); err != nil {
+		return err
+	}
+	if err := relsWriter.Write([]string{":START_ID", ":END_ID", ":TYPE"}); err != nil {
+		return err
+	}
+
+	seenAccounts := map[string]bool{}
+
+	for _, user := range userList {
+		if !seenAccounts[user.accountId] {
+			if err := nodesWriter.Write([]string{user.accountId, "Account", "", "", "", "", "", ""}); err != nil {
+				return err
+			}
+			seenAccounts[user.accountId] = true
+		}
+
+		userID := userNodeID(user)
+		if err := nodesWriter.Write([]string{userID, "User", user.name, userID, "", "", "", ""}); err != nil {
+			return err
+		}
+		if err := relsWriter.Write([]string{user.accountId, userID, "CONTAINS"}); err != nil {
+			return err
+		}
+
+		for _, key := range user.accessKeys {
+			if err := nodesWriter.Write([]string{
+				key.keyId, "AccessKey", "", "", key.createdDate, key.lastUsedDate, key.status, strconv.Itoa(key.ageDays),
+			}); err != nil {
+				return err
+			}
+			if err := relsWriter.Write([]string{userID, key.keyId, "OWNS"}); err != nil {
+				return err
+			}
+		}
+	}
+
+	nodesWriter.Flush()
+	if err := nodesWriter.Error(); err != nil {
+		return err
+	}
+
+	relsWriter.Flush()
+	return relsWriter.Error()
+}
+
+func (e *graphExporter) exportCypher(userList []outputUser) error {
+	f, err := os.Create(e.cypherFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	seenAccounts := map[string]bool{}
+
+	for _, user := range userList {
+		if !seenAccounts[user.accountId] {
+			if _, err := fmt.Fprintf(f, "MERGE (:Account {id: %q});\n", user.accountId); err != nil {
+				return err
+			}
+			seenAccounts[user.accountId] = true
+		}
+
+		userID := userNodeID(user)
+		if _, err := fmt.Fprintf(f, "MERGE (:User {arn: %q, name: %q});\n", userID, user.name); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(f,
+			"MATCH (a:Account {id: %q}), (u:User {arn: %q}) MERGE (a)-[:CONTAINS]->(u);\n",
+			user.accountId, userID,
+		); err != nil {
+			return err
+		}
+
+		for _, key := range user.accessKeys {
+			if _, err := fmt.Fprintf(f,
+				"MERGE (k:AccessKey {id: %q}) SET k.createdDate = %q, k.lastUsed = %q, k.status = %q, k.ageDays = %d;\n",
+				key.keyId, key.createdDate, key.lastUsedDate, key.status, key.ageDays,
+			); err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(f,
+				"MATCH (u:User {arn: %q}), (k:AccessKey {id: %q}) MERGE (u)-[:OWNS]->(k);\n",
+				userID, key.keyId,
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+// Package auth resolves an aws.Config for a target account using one of
+// several supported authentication methods, so a single run can mix
+// cross-account-role-managed accounts with SSO-managed or profile-managed
+// ones.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// throttlingErrorCodes are AWS error codes that should be retried with
+// backoff on top of the SDK's own default retryable conditions.
+var throttlingErrorCodes = []string{"ThrottlingException", "Throttling", "RequestLimitExceeded"}
+
+// NewRetryer returns an aws.RetryerV2 that retries throttling errors with
+// exponential backoff and full jitter, so a scan across hundreds of
+// accounts backs off instead of failing outright when IAM throttles it.
+func NewRetryer(maxAttempts int) aws.RetryerV2 {
+	codes := make(map[string]struct{}, len(throttlingErrorCodes))
+	for _, code := range throttlingErrorCodes {
+		codes[code] = struct{}{}
+	}
+
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = maxAttempts
+		o.Backoff = retry.NewExponentialJitterBackoff(30 * time.Second)
+		o.Retryables = append(o.Retryables, retry.RetryableErrorCode{Codes: codes})
+	})
+}
+
+// Method identifies how credentials for an account should be obtained.
+type Method string
+
+const (
+	// MethodAssumeRole assumes RoleARN using the resolver's base credentials.
+	MethodAssumeRole Method = "assume_role"
+	// MethodSSO resolves credentials from an AWS IAM Identity Center (SSO)
+	// managed profile in ~/.aws/config.
+	MethodSSO Method = "sso"
+	// MethodProfile uses a named shared config/credentials profile directly,
+	// with no assume-role step.
+	MethodProfile Method = "profile"
+	// MethodEnv uses the default credential chain (e.g. environment
+	// variables or an EC2/ECS/Lambda execution role), with no profile.
+	MethodEnv Method = "env"
+)
+
+// AccountConfig describes a single row of the account list: which account to
+// target and which auth method (with its method-specific fields) to use to
+// reach it.
+type AccountConfig struct {
+	AccountID string
+	Method    Method
+
+	// RoleARN and ExternalID are used by MethodAssumeRole.
+	RoleARN    string
+	ExternalID string
+
+	// MFASerialNumber is used by MethodAssumeRole when the target role
+	// requires MFA. When set, the token code is read from stdin at the
+	// point the role is assumed, so a run against an MFA-protected role is
+	// expected to be driven interactively.
+	MFASerialNumber string
+
+	// SSOAccountID and SSORoleName are used by MethodSSO to validate that
+	// ProfileName actually resolves to the account and role the CSV row
+	// declares, by checking them against the caller identity STS returns.
+	// The actual SSO session parameters (start URL, region, account id,
+	// role name) live in the ProfileName's [sso-session]/profile block in
+	// ~/.aws/config; these fields exist to catch a stale or misconfigured
+	// ProfileName rather than to drive the sign-in itself.
+	SSOAccountID string
+	SSORoleName  string
+
+	// ProfileName is used by MethodSSO and MethodProfile to select a named
+	// profile from the shared AWS config/credentials files.
+	ProfileName string
+}
+
+// Resolver resolves an aws.Config for an AccountConfig, dispatching to the
+// strategy appropriate for its Method.
+type Resolver struct {
+	baseConfig  aws.Config
+	retryer     aws.RetryerV2
+	sessionName string
+}
+
+// NewResolver builds a Resolver that assumes roles using baseConfig's
+// credentials as the starting identity. Every aws.Config it resolves is
+// configured with retryer, so throttling on any account backs off instead
+// of failing the whole run. sessionName is used as the assumed-role session
+// name, so CloudTrail shows what a run intended to do (e.g. callers pass a
+// distinct name for a mutating action versus a read-only report).
+func NewResolver(baseConfig aws.Config, retryer aws.RetryerV2, sessionName string) *Resolver {
+	return &Resolver{baseConfig: baseConfig, retryer: retryer, sessionName: sessionName}
+}
+
+func (r *Resolver) retryerOption() func(*config.LoadOptions) error {
+	return config.WithRetryer(func() aws.Retryer {
+		return r.retryer
+	})
+}
+
+// Resolve returns an aws.Config for the given account, using the auth
+// method it declares.
+func (r *Resolver) Resolve(ctx context.Context, account AccountConfig) (aws.Config, error) {
+	switch account.Method {
+	case MethodAssumeRole, "":
+		return r.resolveAssumeRole(ctx, account)
+	case MethodSSO:
+		return r.resolveSSO(ctx, account)
+	case MethodProfile:
+		return r.resolveProfile(ctx, account)
+	case MethodEnv:
+		return r.resolveEnv(ctx, account)
+	default:
+		return aws.Config{}, fmt.Errorf("unsupported auth method %q for account %s", account.Method, account.AccountID)
+	}
+}
+
+func (r *Resolver) resolveAssumeRole(ctx context.Context, account AccountConfig) (aws.Config, error) {
+	if account.RoleARN == "" {
+		return aws.Config{}, fmt.Errorf("account %s: role_arn is required for the assume_role auth method", account.AccountID)
+	}
+
+	stsSvc := sts.NewFromConfig(r.baseConfig, func(o *sts.Options) {
+		o.Retryer = r.retryer
+	})
+
+	assumeRoleInput := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(account.RoleARN),
+		RoleSessionName: aws.String(r.sessionName),
+	}
+	if account.ExternalID != "" {
+		assumeRoleInput.ExternalId = aws.String(account.ExternalID)
+	}
+	if account.MFASerialNumber != "" {
+		tokenCode, err := stscreds.StdinTokenProvider()
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("account %s: error reading MFA token code for serial %s: %w", account.AccountID, account.MFASerialNumber, err)
+		}
+		assumeRoleInput.SerialNumber = aws.String(account.MFASerialNumber)
+		assumeRoleInput.TokenCode = aws.String(tokenCode)
+	}
+
+	tempCredentials, err := stsSvc.AssumeRole(ctx, assumeRoleInput)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("account %s: error when assuming role %s: %w", account.AccountID, account.RoleARN, err)
+	}
+
+	return config.LoadDefaultConfig(ctx,
+		config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(
+				*tempCredentials.Credentials.AccessKeyId,
+				*tempCredentials.Credentials.SecretAccessKey,
+				*tempCredentials.Credentials.SessionToken,
+			),
+		),
+		r.retryerOption(),
+	)
+}
+
+func (r *Resolver) resolveSSO(ctx context.Context, account AccountConfig) (aws.Config, error) {
+	if account.ProfileName == "" {
+		return aws.Config{}, fmt.Errorf("account %s: profile_name is required for the sso auth method", account.AccountID)
+	}
+
+	// aws-sdk-go-v2/config resolves the SSO token provider from the
+	// [sso-session ...] / sso_start_url block referenced by the profile, so
+	// no extra plumbing is needed beyond selecting the profile.
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(account.ProfileName), r.retryerOption())
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	if account.SSOAccountID != "" || account.SSORoleName != "" {
+		if err := r.validateSSOIdentity(ctx, cfg, account); err != nil {
+			return aws.Config{}, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// validateSSOIdentity confirms the identity cfg resolves to via STS
+// GetCallerIdentity actually matches account.SSOAccountID/SSORoleName, so a
+// stale or misconfigured ProfileName is caught instead of silently scanning
+// the wrong account or role.
+func (r *Resolver) validateSSOIdentity(ctx context.Context, cfg aws.Config, account AccountConfig) error {
+	stsSvc := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		o.Retryer = r.retryer
+	})
+
+	identity, err := stsSvc.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("account %s: error validating resolved identity for profile %s: %w", account.AccountID, account.ProfileName, err)
+	}
+
+	if account.SSOAccountID != "" && aws.ToString(identity.Account) != account.SSOAccountID {
+		return fmt.Errorf("account %s: profile %s resolved to account %s, expected sso_account_id %s", account.AccountID, account.ProfileName, aws.ToString(identity.Account), account.SSOAccountID)
+	}
+
+	if account.SSORoleName != "" && !ssoRoleNameMatches(aws.ToString(identity.Arn), account.SSORoleName) {
+		return fmt.Errorf("account %s: profile %s resolved to %s, expected sso_role_name %s", account.AccountID, account.ProfileName, aws.ToString(identity.Arn), account.SSORoleName)
+	}
+
+	return nil
+}
+
+// ssoRoleNameMatches reports whether identityArn, an assumed-role ARN
+// returned by GetCallerIdentity for an SSO/Identity Center session, was
+// assumed via the permission set roleName. Identity Center names the
+// assumed role "AWSReservedSSO_<permission set name>_<hash>", so the
+// assumed-role path segment is matched by prefix rather than equality.
+func ssoRoleNameMatches(identityArn, roleName string) bool {
+	parts := strings.Split(identityArn, "/")
+	if len(parts) < 2 {
+		return false
+	}
+
+	return strings.HasPrefix(parts[1], "AWSReservedSSO_"+roleName+"_")
+}
+
+func (r *Resolver) resolveProfile(ctx context.Context, account AccountConfig) (aws.Config, error) {
+	if account.ProfileName == "" {
+		return aws.Config{}, fmt.Errorf("account %s: profile_name is required for the profile auth method", account.AccountID)
+	}
+
+	return config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(account.ProfileName), r.retryerOption())
+}
+
+func (r *Resolver) resolveEnv(ctx context.Context, _ AccountConfig) (aws.Config, error) {
+	return config.LoadDefaultConfig(ctx, r.retryerOption())
+}
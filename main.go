@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/iam/types"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/alvin-rw/aws-access-keys-id-lister/internal/auth"
 )
 
 type inputUser struct {
@@ -27,22 +30,54 @@ type outputUser struct {
 }
 
 type accessKey struct {
-	keyId       string
-	createdDate string
+	keyId           string
+	createdDate     string
+	status          string
+	ageDays         int
+	severity        string
+	lastUsedDate    string
+	lastUsedService string
+	lastUsedRegion  string
+}
+
+// workerResult is what a worker sends back for a single inputUser: either
+// the user's access keys, or the error encountered while fetching them.
+// Both fields are nil when the user has no access keys.
+type workerResult struct {
+	user *outputUser
+	err  *accountError
 }
 
 // application struct holds the dependencies for the program
 type application struct {
 	logger *zap.Logger
+	opts   options
 }
 
 // options holds the user custom parameters
 type options struct {
-	awsProfileName  string
-	showDebug       bool
-	accountListFile string
-	outputFile      string
-	numOfWorker     int
+	awsProfileName      string
+	showDebug           bool
+	accountListFile     string
+	outputFile          string
+	numOfWorker         int
+	warnDays            int
+	staleDays           int
+	unusedDays          int
+	onlyViolations      bool
+	errorsFile          string
+	maxErrorRate        float64
+	maxRetryAttempts    int
+	accountWorkers      int
+	graphExport         bool
+	graphFormat         string
+	graphOutputDir      string
+	graphOutputFile     string
+	action              string
+	actionOlderThanDays int
+	dryRun              bool
+	confirmModifyIAM    bool
+	auditFile           string
 }
 
 func main() {
@@ -53,6 +88,23 @@ func main() {
 	flag.StringVar(&opts.accountListFile, "account-list-file", "accountlist.csv", "Account list file name")
 	flag.StringVar(&opts.outputFile, "output-file", "output.csv", "Name of the output CSV file (default: output.csv)")
 	flag.IntVar(&opts.numOfWorker, "workers", 10, "Number of worker to use")
+	flag.IntVar(&opts.warnDays, "warn-days", 60, "Key age in days at which a key is classified as \"warn\"")
+	flag.IntVar(&opts.staleDays, "stale-days", 90, "Key age in days at which a key is classified as \"stale\"")
+	flag.IntVar(&opts.unusedDays, "unused-days", 180, "Key age in days at which a key is classified as \"unused\"")
+	flag.BoolVar(&opts.onlyViolations, "only-violations", false, "Only include keys that breach the rotation policy (severity other than \"ok\") in the output")
+	flag.StringVar(&opts.errorsFile, "errors-file", "errors.csv", "Name of the CSV file summarizing per-account/per-user failures")
+	flag.Float64Var(&opts.maxErrorRate, "max-error-rate", 0.5, "Maximum fraction (0.0-1.0) of accounts and users allowed to fail before the program exits non-zero")
+	flag.IntVar(&opts.maxRetryAttempts, "max-retry-attempts", 5, "Maximum number of attempts for AWS calls that are throttled")
+	flag.IntVar(&opts.accountWorkers, "account-workers", 10, "Number of accounts to discover users for concurrently")
+	flag.BoolVar(&opts.graphExport, "graph-export", false, "Additionally export discovered accounts/users/access keys as a graph for bulk-loading into Neo4j")
+	flag.StringVar(&opts.graphFormat, "graph-format", "csv", "Graph export serialization: \"csv\" (nodes.csv/rels.csv for neo4j-admin import) or \"cypher\" (a stream of MERGE statements)")
+	flag.StringVar(&opts.graphOutputDir, "graph-output-dir", "graph-export", "Directory to write nodes.csv/rels.csv into when --graph-format=csv")
+	flag.StringVar(&opts.graphOutputFile, "graph-output-file", "graph.cypher", "File to write MERGE statements into when --graph-format=cypher")
+	flag.StringVar(&opts.action, "action", actionReport, "Action to take on discovered access keys: \"report\" (default, read-only), \"deactivate\", or \"delete\"")
+	flag.IntVar(&opts.actionOlderThanDays, "action-older-than-days", 180, "Only --action=deactivate/delete access keys at least this many days old")
+	flag.BoolVar(&opts.dryRun, "dry-run", true, "Log what --action would do without calling IAM; pass -dry-run=false to actually mutate")
+	flag.BoolVar(&opts.confirmModifyIAM, "i-understand-this-modifies-iam", false, "Required in addition to -dry-run=false to run a mutating --action")
+	flag.StringVar(&opts.auditFile, "audit-file", "audit.csv", "Name of the CSV file recording every --action mutation attempt")
 	flag.Parse()
 
 	logger := createLogger(opts.showDebug)
@@ -60,6 +112,14 @@ func main() {
 
 	app := &application{
 		logger: logger,
+		opts:   opts,
+	}
+
+	if opts.action != actionReport && opts.action != actionDeactivate && opts.action != actionDelete {
+		app.logger.Fatal("invalid -action, must be one of report, deactivate, delete", zap.String("action", opts.action))
+	}
+	if opts.action != actionReport && !opts.dryRun && !opts.confirmModifyIAM {
+		app.logger.Fatal("refusing to run a non-dry-run mutating -action without -i-understand-this-modifies-iam")
 	}
 
 	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion("us-east-1"), config.WithSharedConfigProfile(opts.awsProfileName))
@@ -67,112 +127,224 @@ func main() {
 		app.logger.Fatal("error when loading default config", zap.Error(err))
 	}
 
-	stsSvc := sts.NewFromConfig(cfg)
+	authResolver := auth.NewResolver(cfg, auth.NewRetryer(opts.maxRetryAttempts), assumeRoleSessionName(opts.action))
 
-	csvAccountRoleList, err := getAccountRoleListFromCSV(opts.accountListFile)
+	accountList, err := getAccountRoleListFromCSV(opts.accountListFile)
 	if err != nil {
 		app.logger.Fatal("error when reading account list file", zap.Error(err))
 	}
 
-	inputUserList := []inputUser{}
+	var accountErrorsMu sync.Mutex
+	accountErrors := []accountError{}
 
-	for _, csvAccountRole := range csvAccountRoleList {
-		accountId := getAccountId(csvAccountRole)
-		roleARN := getRoleARN(csvAccountRole)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		app.logger.Info("processing account",
-			zap.String("account_id", accountId))
+	// Stage 1: an account-level worker pool assumes each account's role (or
+	// resolves its other auth method) and paginates ListUsers, streaming
+	// inputUser values into inputUserChan as they're discovered instead of
+	// waiting for every account to finish first.
+	inputUserChan := make(chan inputUser, opts.numOfWorker)
 
-		tempCredentials, err := stsSvc.AssumeRole(context.Background(), &sts.AssumeRoleInput{
-			RoleArn:         &roleARN,
-			RoleSessionName: aws.String("aws-access-key-lister"),
-		})
-		if err != nil {
-			app.logger.Fatal("error when doing assume role",
-				zap.String("role_arn", roleARN),
-				zap.Error(err),
-			)
-		}
-
-		assumeRoleConfig, err := config.LoadDefaultConfig(context.Background(), config.WithCredentialsProvider(
-			credentials.NewStaticCredentialsProvider(
-				*tempCredentials.Credentials.AccessKeyId,
-				*tempCredentials.Credentials.SecretAccessKey,
-				*tempCredentials.Credentials.SessionToken,
-			),
-		))
-		if err != nil {
-			app.logger.Fatal("error when creating temporary config from the assumed role credentials",
-				zap.String("role_arn", roleARN),
-				zap.Error(err),
-			)
-		}
+	accountGroup, accountCtx := errgroup.WithContext(ctx)
+	accountGroup.SetLimit(opts.accountWorkers)
 
-		assumeRoleIAMSvc := iam.NewFromConfig(assumeRoleConfig)
+	for _, account := range accountList {
+		account := account
 
-		listUsersInput := &iam.ListUsersInput{}
+		accountGroup.Go(func() error {
+			app.logger.Info("processing account",
+				zap.String("account_id", account.AccountID),
+				zap.String("auth_method", string(account.Method)),
+			)
 
-		app.logger.Debug("listing user account", zap.String("account_id", accountId))
-		for {
-			listUsersOutput, err := assumeRoleIAMSvc.ListUsers(context.Background(), listUsersInput)
-			if err != nil {
-				app.logger.Fatal("error when listing user", zap.Error(err))
+			users, accErrs := app.processAccount(accountCtx, authResolver, account)
+			if len(accErrs) > 0 {
+				accountErrorsMu.Lock()
+				accountErrors = append(accountErrors, accErrs...)
+				accountErrorsMu.Unlock()
 			}
 
-			for _, user := range listUsersOutput.Users {
-				inputUserList = append(inputUserList, inputUser{
-					name:      *user.UserName,
-					accountId: accountId,
-					iamClient: assumeRoleIAMSvc,
-				})
+			for _, user := range users {
+				select {
+				case inputUserChan <- user:
+				case <-accountCtx.Done():
+					return accountCtx.Err()
+				}
 			}
 
-			if listUsersOutput.IsTruncated {
-				listUsersInput.Marker = listUsersOutput.Marker
-			} else {
-				break
-			}
-		}
+			return nil
+		})
 	}
 
-	numberOfUsers := len(inputUserList)
-
-	numOfWorker := opts.numOfWorker
-	inputUserChan := make(chan inputUser, numberOfUsers)
-	resultChan := make(chan *outputUser)
-
-	for i := 1; i <= numOfWorker; i++ {
-		go app.worker(i, inputUserChan, resultChan)
+	go func() {
+		// Account failures are isolated into accountErrors above and never
+		// fail the group, so this only returns non-nil on context
+		// cancellation (e.g. a future graceful-shutdown signal).
+		_ = accountGroup.Wait()
+		close(inputUserChan)
+	}()
+
+	// Stage 2: the existing per-user worker pool consumes inputUserChan as
+	// it's populated by stage 1, so the two phases overlap instead of
+	// running back to back.
+	resultChan := make(chan workerResult)
+	auditChan := make(chan actionAuditEntry)
+
+	var userWorkerWG sync.WaitGroup
+	for i := 1; i <= opts.numOfWorker; i++ {
+		userWorkerWG.Add(1)
+		go func(workerID int) {
+			defer userWorkerWG.Done()
+			app.worker(workerID, inputUserChan, resultChan, auditChan)
+		}(i)
 	}
 
-	for i := 0; i < numberOfUsers; i++ {
-		inputUserChan <- inputUserList[i]
-	}
-	close(inputUserChan)
+	go func() {
+		userWorkerWG.Wait()
+		close(resultChan)
+		close(auditChan)
+	}()
 
 	userList := []outputUser{}
+	numberOfUsers := 0
+	auditEntries := []actionAuditEntry{}
+	actionErrors := []accountError{}
+
+	auditDone := make(chan struct{})
+	go func() {
+		for entry := range auditChan {
+			auditEntries = append(auditEntries, entry)
+		}
+		close(auditDone)
+	}()
 
-	for i := 0; i < numberOfUsers; i++ {
-		user := <-resultChan
+	for result := range resultChan {
+		numberOfUsers++
 
-		if user != nil {
-			userList = append(userList, *user)
+		if result.user != nil {
+			userList = append(userList, *result.user)
+		}
+		if result.err != nil {
+			accountErrorsMu.Lock()
+			accountErrors = append(accountErrors, *result.err)
+			accountErrorsMu.Unlock()
+		}
+	}
+	<-auditDone
+
+	// apply_action failures are mutation attempts against individual keys,
+	// not discovery failures, so they're tracked separately from
+	// accountErrors and don't factor into the --max-error-rate ratio below;
+	// they're still surfaced in errors.csv and audit.csv.
+	for _, entry := range auditEntries {
+		if entry.err != nil {
+			actionErrors = append(actionErrors, newAccountError(entry.accountId, "apply_action", entry.err))
 		}
 	}
 
-	err = writeRecordsToCSV(opts.outputFile, userList)
+	exporters := []Exporter{
+		&csvExporter{filename: opts.outputFile, onlyViolations: opts.onlyViolations},
+	}
+	if opts.graphExport {
+		exporters = append(exporters, &graphExporter{
+			format:     graphFormat(opts.graphFormat),
+			outputDir:  opts.graphOutputDir,
+			cypherFile: opts.graphOutputFile,
+		})
+	}
+
+	for _, exporter := range exporters {
+		if err := exporter.Export(userList); err != nil {
+			app.logger.Fatal("error when exporting records", zap.Error(err))
+		}
+	}
+
+	err = writeErrorsToCSV(opts.errorsFile, append(accountErrors, actionErrors...))
 	if err != nil {
-		app.logger.Fatal("error when writing records to CSV file",
+		app.logger.Fatal("error when writing errors CSV file",
 			zap.Error(err),
 		)
 	}
 
+	if opts.action != actionReport {
+		err = writeAuditCSV(opts.auditFile, auditEntries)
+		if err != nil {
+			app.logger.Fatal("error when writing audit CSV file",
+				zap.Error(err),
+			)
+		}
+	}
+
+	totalUnits := len(accountList) + numberOfUsers
+	errorRate := 0.0
+	if totalUnits > 0 {
+		errorRate = float64(len(accountErrors)) / float64(totalUnits)
+	}
+
+	app.logger.Info("run finished",
+		zap.Int("errors", len(accountErrors)),
+		zap.Int("action_errors", len(actionErrors)),
+		zap.Float64("error_rate", errorRate),
+	)
+
+	if errorRate > opts.maxErrorRate {
+		app.logger.Error("failure rate exceeded max-error-rate, exiting non-zero",
+			zap.Float64("error_rate", errorRate),
+			zap.Float64("max_error_rate", opts.maxErrorRate),
+		)
+		os.Exit(1)
+	}
+}
+
+// processAccount resolves credentials for account and paginates through its
+// IAM users. Any failure is returned as an accountError instead of
+// aborting the run, so one missing role or one throttled account does not
+// take down a multi-hundred-account scan.
+func (app *application) processAccount(ctx context.Context, resolver *auth.Resolver, account auth.AccountConfig) ([]inputUser, []accountError) {
+	accountConfig, err := resolver.Resolve(ctx, account)
+	if err != nil {
+		return nil, []accountError{newAccountError(account.AccountID, "resolve_credentials", err)}
+	}
+
+	accountIAMSvc := iam.NewFromConfig(accountConfig)
+
+	users := []inputUser{}
+	listUsersInput := &iam.ListUsersInput{}
+
+	app.logger.Debug("listing user account", zap.String("account_id", account.AccountID))
+	for {
+		listUsersOutput, err := accountIAMSvc.ListUsers(ctx, listUsersInput)
+		if err != nil {
+			return users, []accountError{newAccountError(account.AccountID, "list_users", err)}
+		}
+
+		for _, user := range listUsersOutput.Users {
+			users = append(users, inputUser{
+				name:      *user.UserName,
+				accountId: account.AccountID,
+				iamClient: accountIAMSvc,
+			})
+		}
+
+		if listUsersOutput.IsTruncated {
+			listUsersInput.Marker = listUsersOutput.Marker
+		} else {
+			break
+		}
+	}
+
+	return users, nil
 }
 
 // worker function will try to get access key for each user.
 // If access keys are found, they will be added to the resultChan.
-// If no access keys are found, worker will send nil to the resultChan.
-func (app *application) worker(id int, inputUserChan <-chan inputUser, resultChan chan<- *outputUser) {
+// If no access keys are found, worker will send an empty workerResult to
+// the resultChan. Any AWS error encountered for a user is sent as an
+// accountError instead of aborting the worker, so the rest of the run
+// continues. When app.opts.action is a mutating action, every key old
+// enough to be a candidate also produces an actionAuditEntry on auditChan.
+func (app *application) worker(id int, inputUserChan <-chan inputUser, resultChan chan<- workerResult, auditChan chan<- actionAuditEntry) {
 	for inputUser := range inputUserChan {
 		outputAccessKeyList := []types.AccessKeyMetadata{}
 
@@ -180,6 +352,7 @@ func (app *application) worker(id int, inputUserChan <-chan inputUser, resultCha
 			UserName: &inputUser.name,
 		}
 
+		listErr := error(nil)
 		for {
 			app.logger.Debug("listing access key for user",
 				zap.Int("worker_id", id),
@@ -188,7 +361,8 @@ func (app *application) worker(id int, inputUserChan <-chan inputUser, resultCha
 
 			listAccessKeysOutput, err := inputUser.iamClient.ListAccessKeys(context.Background(), listAccessKeysInput)
 			if err != nil {
-				log.Fatalf("error when listing access key, %v", err) //TODO: handle error
+				listErr = err
+				break
 			}
 
 			app.logger.Debug("checking if we found access key",
@@ -219,32 +393,84 @@ func (app *application) worker(id int, inputUserChan <-chan inputUser, resultCha
 			}
 		}
 
-		if len(outputAccessKeyList) != 0 {
-			app.logger.Debug("putting user access key to the result channel",
-				zap.Int("worker_id", id),
-				zap.String("username", inputUser.name),
-			)
+		if listErr != nil {
+			accErr := newAccountError(inputUser.accountId, "list_access_keys", listErr)
+			resultChan <- workerResult{err: &accErr}
+			continue
+		}
+
+		if len(outputAccessKeyList) == 0 {
+			resultChan <- workerResult{}
+			continue
+		}
+
+		app.logger.Debug("putting user access key to the result channel",
+			zap.Int("worker_id", id),
+			zap.String("username", inputUser.name),
+		)
+
+		accessKeys := []accessKey{}
+		var lastUsedErr error
+		for _, ak := range outputAccessKeyList {
+			ageDays := int(time.Since(*ak.CreateDate).Hours() / 24)
 
-			accessKeys := []accessKey{}
-			for _, ak := range outputAccessKeyList {
-				accessKeys = append(accessKeys, accessKey{
-					keyId:       *ak.AccessKeyId,
-					createdDate: ak.CreateDate.Format("2006-01-02T15:04:05-07:00"),
+			key := accessKey{
+				keyId:       *ak.AccessKeyId,
+				createdDate: ak.CreateDate.Format("2006-01-02T15:04:05-07:00"),
+				status:      string(ak.Status),
+				ageDays:     ageDays,
+			}
+
+			daysSinceLastUsed := -1
+			if ak.Status == types.StatusTypeActive {
+				app.logger.Debug("fetching last used info for access key",
+					zap.Int("worker_id", id),
+					zap.String("username", inputUser.name),
+					zap.String("access_key_id", *ak.AccessKeyId),
+				)
+
+				lastUsedOutput, err := inputUser.iamClient.GetAccessKeyLastUsed(context.Background(), &iam.GetAccessKeyLastUsedInput{
+					AccessKeyId: ak.AccessKeyId,
 				})
+				if err != nil {
+					lastUsedErr = err
+					break
+				}
+
+				if lastUsedOutput.AccessKeyLastUsed.LastUsedDate != nil {
+					key.lastUsedDate = lastUsedOutput.AccessKeyLastUsed.LastUsedDate.Format("2006-01-02T15:04:05-07:00")
+					daysSinceLastUsed = int(time.Since(*lastUsedOutput.AccessKeyLastUsed.LastUsedDate).Hours() / 24)
+				}
+				key.lastUsedService = aws.ToString(lastUsedOutput.AccessKeyLastUsed.ServiceName)
+				key.lastUsedRegion = aws.ToString(lastUsedOutput.AccessKeyLastUsed.Region)
+			}
+
+			key.severity = classifyKeySeverity(ageDays, daysSinceLastUsed, app.opts.warnDays, app.opts.staleDays, app.opts.unusedDays)
+
+			if entry := app.applyAction(context.Background(), inputUser.iamClient, inputUser.accountId, inputUser.name, ak, ageDays); entry != nil {
+				auditChan <- *entry
 			}
 
-			resultChan <- &outputUser{
+			accessKeys = append(accessKeys, key)
+		}
+
+		if lastUsedErr != nil {
+			accErr := newAccountError(inputUser.accountId, "get_access_key_last_used", lastUsedErr)
+			resultChan <- workerResult{err: &accErr}
+			continue
+		}
+
+		resultChan <- workerResult{
+			user: &outputUser{
 				name:       inputUser.name,
 				accountId:  inputUser.accountId,
 				accessKeys: accessKeys,
-			}
-
-			app.logger.Debug("finished putting the access key(s) into the result channel",
-				zap.Int("worker_id", id),
-				zap.String("username", inputUser.name),
-			)
-		} else {
-			resultChan <- nil
+			},
 		}
+
+		app.logger.Debug("finished putting the access key(s) into the result channel",
+			zap.Int("worker_id", id),
+			zap.String("username", inputUser.name),
+		)
 	}
 }